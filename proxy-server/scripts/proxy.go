@@ -15,34 +15,133 @@ Flags:
   -origin string CORS origin to allow (default "*")
   -username string Basic auth username
   -password string Basic auth password
+  -auth-config string   Path to JSON file with bearer/proxy-access tokens
+  -inject-config string Path to JSON file with per-target credential injection rules
+  -cors-config string   Path to JSON file with per-target CORS policies
+  -tls-cert string  Path to a TLS certificate (enables HTTPS + HTTP/2)
+  -tls-key string   Path to the matching TLS private key
+  -https-port int   Port for the HTTPS listener (default 9443)
+  -timeout duration      Upstream request timeout, 0 disables it (default 0)
+  -idle-timeout duration Keep-alive idle timeout for both listeners (default 2m)
+  -max-body int          Max request body size in bytes, 0 disables the limit
+  -cache string          Cache mode: off, revalidate, or replay (default "off")
+  -cache-dir string      Directory for on-disk cache entries (default ".proxy-cache")
+  -cache-max-entries int Max cached entries before the LRU evicts (default 500)
+  -rewrite-config string Path to JSON file with request rewrite rules
+  -record-file string    Path to a HAR file to record request/response pairs into
+  -record-max-body int   Max response body bytes captured per recording (default 1MB)
+  -record-redact string  Comma-separated header names to redact when recording (default "Authorization,Cookie,Set-Cookie,Proxy-Authorization")
+  -mock          Serve responses from -record-file instead of forwarding upstream
   -verbose       Enable verbose logging
+
+Sending SIGHUP reloads -auth-config, -inject-config, -cors-config and
+-rewrite-config without restarting.
+
+/health reports uptime, in-flight requests and the running request total;
+/metrics exposes the same plus per-target-host request/latency/byte counters
+in Prometheus text format; both /metrics and /debug/pprof require the same
+auth as proxied requests. Every proxied request is assigned an X-Request-Id
+(generated unless the client already sent one) and a W3C traceparent
+(likewise), both forwarded to upstream so traces can be correlated end to
+end; -verbose now emits one JSON line per request with that request id,
+target, method, status, duration and bytes in/out instead of the previous
+free-text log lines.
+
+Without -cors-config, the proxy falls back to a single policy built from
+-origin, matching the previous behaviour.
+
+When -tls-cert/-tls-key are set, the proxy serves plain HTTP on -port and
+HTTPS (with HTTP/2) on -https-port at the same time, so it can sit behind
+https:// origins that would otherwise refuse it as mixed content. Streaming
+responses (SSE, chunked, long-poll) are flushed to the client as they
+arrive, and `Upgrade: websocket` requests are hijacked and piped
+bidirectionally to the target instead of being proxied as ordinary HTTP.
+
+-cache revalidate honors upstream Cache-Control/ETag/Last-Modified and issues
+If-None-Match/If-Modified-Since revalidations; -cache replay serves
+exclusively from the on-disk cache (useful offline or for deterministic test
+fixtures) and never touches the network. /cache lists cached entries,
+/cache/purge clears them, and /cache/export downloads them as a HAR file.
+
+-rewrite-config lets requests be matched by method, target URL glob or
+header and then have their target URL, headers or JSON body patched before
+being forwarded, so a recorded session (or a flaky upstream) can be
+redirected or mutated without touching client code. -record-file appends
+every forwarded request/response pair (after rewriting) to a HAR file,
+with configured headers redacted and response bodies capped at
+-record-max-body; -mock then serves responses straight out of that file
+instead of reaching upstream at all, turning a recording into a
+replayable fixture for tests or offline demos.
 */
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Config struct {
-	Port     int
-	Host     string
-	Origin   string
-	Username string
-	Password string
-	Verbose  bool
+	Port              int
+	Host              string
+	Origin            string
+	Username          string
+	Password          string
+	AuthConfigPath    string
+	InjectConfigPath  string
+	CORSConfigPath    string
+	TLSCert           string
+	TLSKey            string
+	HTTPSPort         int
+	Timeout           time.Duration
+	IdleTimeout       time.Duration
+	MaxBody           int64
+	CacheMode         string
+	CacheDir          string
+	CacheMaxEntries   int
+	RewriteConfigPath string
+	RecordFile        string
+	RecordMaxBody     int64
+	RecordRedact      string
+	Mock              bool
+	Verbose           bool
 }
 
 type HealthResponse struct {
-	Status  string  `json:"status"`
-	Version string  `json:"version"`
-	Uptime  float64 `json:"uptime"`
+	Status        string  `json:"status"`
+	Version       string  `json:"version"`
+	Uptime        float64 `json:"uptime"`
+	InFlight      int64   `json:"inFlightRequests"`
+	RequestsTotal uint64  `json:"requestsTotal"`
+	CacheMode     string  `json:"cacheMode"`
+	Mock          bool    `json:"mock"`
 }
 
 type ErrorResponse struct {
@@ -50,11 +149,148 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// TokenEntry describes one accepted bearer/access token. Either Token (plain)
+// or Sha256 (lowercase hex digest of the token) must be set; Sha256 lets
+// operators keep a config file in version control without committing secrets.
+//
+// Known deviation from the original request: it asked for optional bcrypt
+// hashes and a JSON-or-YAML config file; -auth-config here is JSON-only and
+// Sha256 is a plain digest, not bcrypt. Both would need an external
+// dependency in a file that is stdlib-only by design (see the package doc
+// comment) - bcrypt support and YAML parsing weren't dropped as obviously
+// unnecessary, they're flagged here as a deviation to confirm with whoever
+// filed the request, since these tokens being high-entropy generated
+// secrets (where bcrypt's slow KDF buys little over a plain digest) is a
+// judgment call, not a given.
+type TokenEntry struct {
+	Name   string `json:"name"`
+	Token  string `json:"token"`
+	Sha256 string `json:"sha256"`
+}
+
+// AuthConfig is the shape of the -auth-config JSON file.
+type AuthConfig struct {
+	Tokens []TokenEntry `json:"tokens"`
+}
+
+// InjectRule declares that requests bound for a matching target should have
+// their client-supplied Authorization stripped and a credential the client
+// never sees injected instead. TargetPrefix and TargetHost are both optional;
+// a rule matches when every non-empty field it sets matches the target URL.
+type InjectRule struct {
+	TargetPrefix string `json:"targetPrefix"`
+	TargetHost   string `json:"targetHost"`
+	Header       string `json:"header"`
+	Value        string `json:"value"`
+}
+
+// InjectConfig is the shape of the -inject-config JSON file.
+type InjectConfig struct {
+	Rules []InjectRule `json:"rules"`
+}
+
+// CORSPolicy replaces the old single -origin string with a full policy:
+// which origins may call, which methods/headers are allowed, which response
+// headers are exposed, how long preflight may be cached, and whether
+// credentialed requests are permitted. AllowedOrigins entries may be an
+// exact origin, "*", a "*"-wildcard glob (e.g. "https://*.example.com"), or
+// a "regex:"-prefixed Go regexp.
+type CORSPolicy struct {
+	TargetGlob       string   `json:"targetGlob"`
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	ExposedHeaders   []string `json:"exposedHeaders"`
+	MaxAge           int      `json:"maxAge"`
+	AllowCredentials bool     `json:"allowCredentials"`
+}
+
+// CORSConfig is the shape of the -cors-config JSON file: an ordered list of
+// policies, the first of which whose TargetGlob matches the request's
+// target URL wins.
+type CORSConfig struct {
+	Policies []CORSPolicy `json:"policies"`
+}
+
+// RewriteRule declares that requests matching Method/URLGlob/HeaderMatch
+// should have their target URL, headers and/or JSON body mutated before
+// being forwarded. An empty Method/URLGlob/HeaderMatch field matches
+// anything; the first rule (in file order) that matches wins.
+type RewriteRule struct {
+	Method        string            `json:"method"`
+	URLGlob       string            `json:"urlGlob"`
+	HeaderMatch   map[string]string `json:"headerMatch"`
+	SetURL        string            `json:"setURL"`
+	SetHeaders    map[string]string `json:"setHeaders"`
+	RemoveHeaders []string          `json:"removeHeaders"`
+	BodyPatches   []BodyPatch       `json:"bodyPatches"`
+}
+
+// BodyPatch sets a single field of a JSON object request body, addressed by
+// a dotted JSONPath-style path (e.g. "user.address.city"). Intermediate
+// objects are created as needed; array indices aren't supported.
+type BodyPatch struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// RewriteConfig is the shape of the -rewrite-config JSON file.
+type RewriteConfig struct {
+	Rules []RewriteRule `json:"rules"`
+}
+
+var defaultCORSPolicy = CORSPolicy{
+	AllowedOrigins:   []string{"*"},
+	AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "HEAD"},
+	AllowCredentials: true,
+	MaxAge:           86400,
+}
+
 var (
 	config    Config
 	startTime time.Time
+
+	authMu     sync.RWMutex
+	authConfig AuthConfig
+
+	injectMu     sync.RWMutex
+	injectConfig InjectConfig
+
+	corsMu     sync.RWMutex
+	corsConfig CORSConfig
+
+	rewriteMu     sync.RWMutex
+	rewriteConfig RewriteConfig
+
+	recordMu      sync.Mutex
+	recordEntries []HAREntry
+
+	inFlightRequests int64  // atomic
+	requestsTotal    uint64 // atomic
+
+	metricsMu     sync.Mutex
+	metricsByHost = map[string]*hostMetrics{}
+
+	proxyErrMu  sync.Mutex
+	proxyErrors = map[string]string{} // requestID -> upstream error message, set by ErrorHandler, consumed once by instrumentProxy
 )
 
+// metricsLatencyBuckets are the histogram bucket boundaries (seconds)
+// exposed by /metrics, chosen to span a typical proxy's sub-millisecond to
+// multi-second round trips.
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// hostMetrics accumulates counters for one target host across the life of
+// the process. statusCounts is keyed by "method|status".
+type hostMetrics struct {
+	statusCounts map[string]uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	durSum       float64
+	durCount     uint64
+	durBuckets   []uint64 // cumulative count per metricsLatencyBuckets entry
+}
+
 func main() {
 	// Parse command line flags
 	flag.IntVar(&config.Port, "port", 9090, "Port to listen on")
@@ -62,33 +298,95 @@ func main() {
 	flag.StringVar(&config.Origin, "origin", "*", "CORS origin to allow")
 	flag.StringVar(&config.Username, "username", "", "Basic auth username")
 	flag.StringVar(&config.Password, "password", "", "Basic auth password")
+	flag.StringVar(&config.AuthConfigPath, "auth-config", "", "Path to JSON file with bearer/proxy-access tokens")
+	flag.StringVar(&config.InjectConfigPath, "inject-config", "", "Path to JSON file with per-target credential injection rules")
+	flag.StringVar(&config.CORSConfigPath, "cors-config", "", "Path to JSON file with per-target CORS policies")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "Path to a TLS certificate (enables HTTPS + HTTP/2)")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "Path to the matching TLS private key")
+	flag.IntVar(&config.HTTPSPort, "https-port", 9443, "Port for the HTTPS listener")
+	flag.DurationVar(&config.Timeout, "timeout", 0, "Upstream request timeout, 0 disables it")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", 2*time.Minute, "Keep-alive idle timeout for both listeners")
+	flag.Int64Var(&config.MaxBody, "max-body", 0, "Max request body size in bytes, 0 disables the limit")
+	flag.StringVar(&config.CacheMode, "cache", "off", "Cache mode: off, revalidate, or replay")
+	flag.StringVar(&config.CacheDir, "cache-dir", ".proxy-cache", "Directory for on-disk cache entries")
+	flag.IntVar(&config.CacheMaxEntries, "cache-max-entries", 500, "Max cached entries before the LRU evicts")
+	flag.StringVar(&config.RewriteConfigPath, "rewrite-config", "", "Path to JSON file with request rewrite rules")
+	flag.StringVar(&config.RecordFile, "record-file", "", "Path to a HAR file to record request/response pairs into")
+	flag.Int64Var(&config.RecordMaxBody, "record-max-body", 1<<20, "Max response body bytes captured per recording")
+	flag.StringVar(&config.RecordRedact, "record-redact", "Authorization,Cookie,Set-Cookie,Proxy-Authorization", "Comma-separated header names to redact when recording")
+	flag.BoolVar(&config.Mock, "mock", false, "Serve responses from -record-file instead of forwarding upstream")
 	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose logging")
 	flag.Parse()
 
 	startTime = time.Now()
 
+	if config.CacheMode != "off" {
+		if err := initCache(); err != nil {
+			log.Fatalf("failed to init -cache-dir: %v", err)
+		}
+	}
+
+	if err := reloadAuthConfig(); err != nil {
+		log.Fatalf("failed to load -auth-config: %v", err)
+	}
+	if err := reloadInjectConfig(); err != nil {
+		log.Fatalf("failed to load -inject-config: %v", err)
+	}
+	if err := reloadCORSConfig(); err != nil {
+		log.Fatalf("failed to load -cors-config: %v", err)
+	}
+	if err := reloadRewriteConfig(); err != nil {
+		log.Fatalf("failed to load -rewrite-config: %v", err)
+	}
+	if config.RecordFile != "" || config.Mock {
+		if err := loadRecording(); err != nil {
+			log.Fatalf("failed to load -record-file: %v", err)
+		}
+	}
+	watchForReload()
+
 	// Set up routes
-	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/", handleProxy)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/metrics", authGuard(handleMetrics))
+	mux.HandleFunc("/cache", handleCacheList)
+	mux.HandleFunc("/cache/purge", handleCachePurge)
+	mux.HandleFunc("/cache/export", handleCacheExport)
+	mux.HandleFunc("/debug/pprof/", authGuard(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", authGuard(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", authGuard(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", authGuard(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", authGuard(pprof.Trace))
+	mux.HandleFunc("/", instrumentProxy(handleProxy))
 
-	// Start server
 	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	httpsAddr := fmt.Sprintf("%s:%d", config.Host, config.HTTPSPort)
+	tlsEnabled := config.TLSCert != "" && config.TLSKey != ""
+
 	fmt.Printf(`
 🚀 API Client CORS Proxy Server (Go) started!
-   
+
    Listening on: http://%s
+   %s
    Health check: http://%s/health
-   
+
    Usage:
    - Add X-Target-URL header with the target API URL
    - Or use ?url=<target-url> query parameter
-   
+
    %s
    %s
 
-`, addr, addr,
+`, addr,
+		func() string {
+			if tlsEnabled {
+				return fmt.Sprintf("Listening on: https://%s (HTTP/2)", httpsAddr)
+			}
+			return ""
+		}(),
+		addr,
 		func() string {
-			if config.Username != "" {
+			if config.Username != "" || len(authConfig.Tokens) > 0 {
 				return "🔒 Authentication enabled"
 			}
 			return "🔓 No authentication"
@@ -100,12 +398,153 @@ func main() {
 			return ""
 		}())
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	errCh := make(chan error, 2)
+
+	httpServer := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		IdleTimeout: config.IdleTimeout,
+	}
+	go func() { errCh <- httpServer.ListenAndServe() }()
+
+	if tlsEnabled {
+		httpsServer := &http.Server{
+			Addr:        httpsAddr,
+			Handler:     mux,
+			IdleTimeout: config.IdleTimeout,
+		}
+		go func() { errCh <- httpsServer.ListenAndServeTLS(config.TLSCert, config.TLSKey) }()
+	}
+
+	log.Fatal(<-errCh)
+}
+
+// watchForReload reloads -auth-config and -inject-config on SIGHUP so
+// operators can rotate tokens and injection rules without restarting the
+// proxy (and dropping in-flight connections).
+func watchForReload() {
+	if config.AuthConfigPath == "" && config.InjectConfigPath == "" && config.CORSConfigPath == "" && config.RewriteConfigPath == "" {
+		return
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			// Each of these is an independent file; a typo in one must not
+			// stop the other three (otherwise-valid) files from being
+			// reloaded on the same signal.
+			ok := true
+			if err := reloadAuthConfig(); err != nil {
+				log.Printf("SIGHUP: failed to reload -auth-config: %v", err)
+				ok = false
+			}
+			if err := reloadInjectConfig(); err != nil {
+				log.Printf("SIGHUP: failed to reload -inject-config: %v", err)
+				ok = false
+			}
+			if err := reloadCORSConfig(); err != nil {
+				log.Printf("SIGHUP: failed to reload -cors-config: %v", err)
+				ok = false
+			}
+			if err := reloadRewriteConfig(); err != nil {
+				log.Printf("SIGHUP: failed to reload -rewrite-config: %v", err)
+				ok = false
+			}
+			if ok {
+				log.Printf("SIGHUP: reloaded auth, injection, CORS and rewrite config")
+			}
+		}
+	}()
+}
+
+func reloadAuthConfig() error {
+	if config.AuthConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.AuthConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var parsed AuthConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parsing %s: %w", config.AuthConfigPath, err)
+	}
+
+	authMu.Lock()
+	authConfig = parsed
+	authMu.Unlock()
+	return nil
+}
+
+func reloadInjectConfig() error {
+	if config.InjectConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.InjectConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var parsed InjectConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parsing %s: %w", config.InjectConfigPath, err)
+	}
+
+	injectMu.Lock()
+	injectConfig = parsed
+	injectMu.Unlock()
+	return nil
+}
+
+func reloadCORSConfig() error {
+	if config.CORSConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.CORSConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var parsed CORSConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parsing %s: %w", config.CORSConfigPath, err)
+	}
+
+	corsMu.Lock()
+	corsConfig = parsed
+	corsMu.Unlock()
+	return nil
+}
+
+func reloadRewriteConfig() error {
+	if config.RewriteConfigPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.RewriteConfigPath)
+	if err != nil {
+		return err
+	}
+
+	var parsed RewriteConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parsing %s: %w", config.RewriteConfigPath, err)
+	}
+
+	rewriteMu.Lock()
+	rewriteConfig = parsed
+	rewriteMu.Unlock()
+	return nil
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, r)
-	
+	setCORSHeaders(w, r, "")
+
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -113,163 +552,1610 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(HealthResponse{
-		Status:  "ok",
-		Version: "1.0.0",
-		Uptime:  time.Since(startTime).Seconds(),
+		Status:        "ok",
+		Version:       "1.0.0",
+		Uptime:        time.Since(startTime).Seconds(),
+		InFlight:      atomic.LoadInt64(&inFlightRequests),
+		RequestsTotal: atomic.LoadUint64(&requestsTotal),
+		CacheMode:     config.CacheMode,
+		Mock:          config.Mock,
 	})
 }
 
-func handleProxy(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w, r)
-	
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusNoContent)
+// --- Observability ---------------------------------------------------------
+//
+// instrumentProxy wraps the "/" handler so every proxied request - whatever
+// branch inside handleProxy ends up serving it - gets the same request-id/
+// traceparent propagation, /metrics counters and structured log line.
+
+// logEntry is the JSON shape of one -verbose log line, replacing the old
+// free-text log.Printf calls.
+type logEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"requestId"`
+	Target     string  `json:"target"`
+	Method     string  `json:"method"`
+	Status     int     `json:"status,omitempty"`
+	DurationMs float64 `json:"durationMs,omitempty"`
+	BytesIn    int64   `json:"bytesIn,omitempty"`
+	BytesOut   int64   `json:"bytesOut,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func logStructured(entry logEntry) {
+	if !config.Verbose {
 		return
 	}
-
-	// Check authentication
-	if !checkAuth(r) {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Proxy"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Unauthorized"))
+	data, err := json.Marshal(entry)
+	if err != nil {
 		return
 	}
+	log.Println(string(data))
+}
 
-	// Extract target URL
-	targetURL := r.Header.Get("X-Target-URL")
-	if targetURL == "" {
-		targetURL = r.URL.Query().Get("url")
-	}
+func generateRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
 
-	if targetURL == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Missing target URL. Use X-Target-URL header or ?url= parameter"))
+// generateTraceparent builds a W3C traceparent header
+// (https://www.w3.org/TR/trace-context/) with a fresh trace and span ID, for
+// requests that didn't arrive with one already.
+func generateTraceparent() string {
+	var traceID [16]byte
+	var spanID [8]byte
+	rand.Read(traceID[:])
+	rand.Read(spanID[:])
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(traceID[:]), hex.EncodeToString(spanID[:]))
+}
+
+// correlationIDContextKey is the request-context key instrumentProxy stores
+// its per-request correlation ID under; see the comment there for why a
+// context value is used instead of a header.
+type correlationIDContextKeyType struct{}
+
+var correlationIDContextKey = correlationIDContextKeyType{}
+
+// setProxyError and popProxyError hand an upstream error from
+// newReverseProxy's ErrorHandler (which has no return path of its own) back
+// to instrumentProxy's post-request log line, keyed by request ID.
+func setProxyError(requestID, msg string) {
+	if requestID == "" {
 		return
 	}
+	proxyErrMu.Lock()
+	proxyErrors[requestID] = msg
+	proxyErrMu.Unlock()
+}
 
-	// Create proxy request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		sendError(w, "Invalid target URL", err)
-		return
+func popProxyError(requestID string) string {
+	proxyErrMu.Lock()
+	defer proxyErrMu.Unlock()
+	msg := proxyErrors[requestID]
+	delete(proxyErrors, requestID)
+	return msg
+}
+
+// countingReadCloser tracks bytes read from the wrapped body, so
+// instrumentProxy can report request body size without buffering it.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// metricsResponseWriter tracks the status code and bytes written to the
+// client. It passes Flush and Hijack through to the underlying
+// ResponseWriter so it doesn't break streaming responses or the WebSocket
+// hijack path.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	bytesOut int64
+}
+
+func (m *metricsResponseWriter) WriteHeader(code int) {
+	m.status = code
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metricsResponseWriter) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
 	}
+	n, err := m.ResponseWriter.Write(b)
+	m.bytesOut += int64(n)
+	return n, err
+}
 
-	// Copy headers
-	skipHeaders := map[string]bool{
-		"Host":               true,
-		"Connection":         true,
-		"Proxy-Authorization": true,
-		"X-Target-URL":       true,
-		"Origin":             true,
-		"Referer":            true,
+func (m *metricsResponseWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	for key, values := range r.Header {
-		if !skipHeaders[key] {
-			for _, value := range values {
-				proxyReq.Header.Add(key, value)
-			}
-		}
+func (m *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := m.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
 	}
+	return hijacker.Hijack()
+}
+
+// instrumentProxy assigns (or propagates) X-Request-Id and a traceparent
+// header before next runs - both flow to upstream automatically since
+// Director forwards all non-hop-by-hop request headers - then records
+// /metrics counters and emits one structured log line once next returns.
+func instrumentProxy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = generateRequestID()
+			r.Header.Set("X-Request-Id", requestID)
+		}
+		if r.Header.Get("Traceparent") == "" {
+			r.Header.Set("Traceparent", generateTraceparent())
+		}
+		w.Header().Set("X-Request-Id", requestID)
+
+		// correlationID, unlike requestID, is always freshly generated and
+		// never taken from the client, so it's safe to use as the key for
+		// stitching an ErrorHandler failure back to this specific call even
+		// when two concurrent requests arrive with the same client-supplied
+		// X-Request-Id. It travels via the request context rather than a
+		// header: Director receives a cloned request with its own header
+		// map (so a header set here would still exist on the clone when
+		// ErrorHandler runs), but Director also deletes every entry in
+		// skipProxyHeaders before RoundTrip - which would delete this too if
+		// it were a header - whereas context values survive Clone untouched.
+		correlationID := generateRequestID()
+		r = r.WithContext(context.WithValue(r.Context(), correlationIDContextKey, correlationID))
+
+		atomic.AddInt64(&inFlightRequests, 1)
+		defer atomic.AddInt64(&inFlightRequests, -1)
+
+		mrw := &metricsResponseWriter{ResponseWriter: w}
+		bodyCounter := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = bodyCounter
 
-	// Log request if verbose
-	if config.Verbose {
-		log.Printf("[%s] %s %s", time.Now().Format("2006-01-02 15:04:05"), r.Method, targetURL)
+		start := time.Now()
+		next(mrw, r)
+		duration := time.Since(start)
+
+		targetURL := r.Header.Get("X-Target-URL")
+		if targetURL == "" {
+			targetURL = r.URL.Query().Get("url")
+		}
+		host := "-"
+		if parsed, err := url.Parse(targetURL); err == nil && parsed.Host != "" {
+			host = parsed.Host
+		}
+
+		atomic.AddUint64(&requestsTotal, 1)
+		recordRequestMetrics(host, r.Method, mrw.status, duration, bodyCounter.n, mrw.bytesOut)
+
+		logStructured(logEntry{
+			Time:       time.Now().UTC().Format(time.RFC3339),
+			RequestID:  requestID,
+			Target:     targetURL,
+			Method:     r.Method,
+			Status:     mrw.status,
+			DurationMs: float64(duration.Microseconds()) / 1000,
+			BytesIn:    bodyCounter.n,
+			BytesOut:   mrw.bytesOut,
+			Error:      popProxyError(correlationID),
+		})
 	}
+}
+
+// maxMetricsHosts bounds how many distinct target hosts /metrics tracks
+// separately. Target hosts come straight from the client-supplied
+// X-Target-URL/?url=, so without a cap a client could grow this map without
+// bound by hitting a new host on every request; once the cap is hit,
+// further new hosts are folded into the "(other)" bucket instead.
+const maxMetricsHosts = 1000
+
+// recordRequestMetrics folds one completed request into /metrics' per-host
+// counters and latency histogram.
+func recordRequestMetrics(host, method string, status int, duration time.Duration, bytesIn, bytesOut int64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
 
-	// Make request
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	hm, ok := metricsByHost[host]
+	if !ok && len(metricsByHost) >= maxMetricsHosts {
+		host = "(other)"
+		hm, ok = metricsByHost[host]
 	}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		sendError(w, "Proxy error", err)
-		if config.Verbose {
-			log.Printf("[%s] %s %s -> Error: %v", time.Now().Format("2006-01-02 15:04:05"), r.Method, targetURL, err)
+	if !ok {
+		hm = &hostMetrics{
+			statusCounts: map[string]uint64{},
+			durBuckets:   make([]uint64, len(metricsLatencyBuckets)),
+		}
+		metricsByHost[host] = hm
+	}
+
+	hm.statusCounts[fmt.Sprintf("%s|%d", method, status)]++
+	hm.bytesIn += uint64(bytesIn)
+	hm.bytesOut += uint64(bytesOut)
+
+	secs := duration.Seconds()
+	hm.durSum += secs
+	hm.durCount++
+	for i, bound := range metricsLatencyBuckets {
+		if secs <= bound {
+			hm.durBuckets[i]++
 		}
+	}
+}
+
+// handleMetrics renders /metrics' in-memory counters as Prometheus text
+// exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r, "")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	defer resp.Body.Close()
 
-	// Log response if verbose
-	if config.Verbose {
-		log.Printf("[%s] %s %s -> %d", time.Now().Format("2006-01-02 15:04:05"), r.Method, targetURL, resp.StatusCode)
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	hosts := make([]string, 0, len(metricsByHost))
+	for host := range metricsByHost {
+		hosts = append(hosts, host)
 	}
+	sort.Strings(hosts)
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		if key != "Connection" && key != "Transfer-Encoding" {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP proxy_in_flight_requests Requests currently being proxied.\n")
+	fmt.Fprintf(&buf, "# TYPE proxy_in_flight_requests gauge\n")
+	fmt.Fprintf(&buf, "proxy_in_flight_requests %d\n", atomic.LoadInt64(&inFlightRequests))
+
+	fmt.Fprintf(&buf, "# HELP proxy_requests_total Requests proxied, by target host, method and upstream status.\n")
+	fmt.Fprintf(&buf, "# TYPE proxy_requests_total counter\n")
+	for _, host := range hosts {
+		keys := make([]string, 0, len(metricsByHost[host].statusCounts))
+		for key := range metricsByHost[host].statusCounts {
+			keys = append(keys, key)
 		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			method, status, _ := strings.Cut(key, "|")
+			fmt.Fprintf(&buf, "proxy_requests_total{host=%q,method=%q,status=%q} %d\n", host, method, status, metricsByHost[host].statusCounts[key])
+		}
+	}
+
+	fmt.Fprintf(&buf, "# HELP proxy_bytes_in_total Request body bytes received from clients, by target host.\n")
+	fmt.Fprintf(&buf, "# TYPE proxy_bytes_in_total counter\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "proxy_bytes_in_total{host=%q} %d\n", host, metricsByHost[host].bytesIn)
 	}
 
-	// Set CORS headers (after copying response headers to override)
-	setCORSHeaders(w, r)
+	fmt.Fprintf(&buf, "# HELP proxy_bytes_out_total Response body bytes sent to clients, by target host.\n")
+	fmt.Fprintf(&buf, "# TYPE proxy_bytes_out_total counter\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&buf, "proxy_bytes_out_total{host=%q} %d\n", host, metricsByHost[host].bytesOut)
+	}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+	fmt.Fprintf(&buf, "# HELP proxy_request_duration_seconds Request latency, by target host.\n")
+	fmt.Fprintf(&buf, "# TYPE proxy_request_duration_seconds histogram\n")
+	for _, host := range hosts {
+		hm := metricsByHost[host]
+		for i, bound := range metricsLatencyBuckets {
+			fmt.Fprintf(&buf, "proxy_request_duration_seconds_bucket{host=%q,le=%q} %d\n", host, strconv.FormatFloat(bound, 'f', -1, 64), hm.durBuckets[i])
+		}
+		fmt.Fprintf(&buf, "proxy_request_duration_seconds_bucket{host=%q,le=\"+Inf\"} %d\n", host, hm.durCount)
+		fmt.Fprintf(&buf, "proxy_request_duration_seconds_sum{host=%q} %s\n", host, strconv.FormatFloat(hm.durSum, 'f', -1, 64))
+		fmt.Fprintf(&buf, "proxy_request_duration_seconds_count{host=%q} %d\n", host, hm.durCount)
+	}
 
-	// Copy response body
-	io.Copy(w, resp.Body)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
 }
 
-func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		origin = "*"
+// authGuard requires checkAuth to pass before calling next, for endpoints
+// (like /metrics and /debug/pprof) that shouldn't be reachable by arbitrary
+// callers even when the proxy itself is otherwise open.
+func authGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Proxy"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
 	}
+}
 
-	if config.Origin == "*" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-	} else {
-		w.Header().Set("Access-Control-Allow-Origin", config.Origin)
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	// Extract target URL up front so CORS policy selection can take the
+	// destination into account. Preflight (OPTIONS) requests made via the
+	// query-parameter form carry it too; the header form does not, since
+	// browsers never send custom headers on the preflight request itself -
+	// in that case setCORSHeaders denies the preflight outright whenever
+	// -cors-config has per-target policies configured, rather than guessing
+	// with a permissive default (see selectCORSPolicy). Clients that need
+	// per-target CORS policies enforced at preflight time must target via
+	// ?url= instead of X-Target-URL.
+	targetURL := r.Header.Get("X-Target-URL")
+	if targetURL == "" {
+		targetURL = r.URL.Query().Get("url")
 	}
 
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, PATCH, OPTIONS, HEAD")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Max-Age", "86400")
-}
+	setCORSHeaders(w, r, targetURL)
 
-func checkAuth(r *http.Request) bool {
-	if config.Username == "" || config.Password == "" {
-		return true
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	auth := r.Header.Get("Proxy-Authorization")
-	if auth == "" {
-		auth = r.Header.Get("Authorization")
+	// Check authentication
+	if !checkAuth(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Proxy"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized"))
+		return
 	}
 
-	if auth == "" {
-		return false
+	if targetURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing target URL. Use X-Target-URL header or ?url= parameter"))
+		return
 	}
 
-	parts := strings.SplitN(auth, " ", 2)
-	if len(parts) != 2 || parts[0] != "Basic" {
-		return false
+	targetParsed, err := url.Parse(targetURL)
+	if err != nil || targetParsed.Host == "" {
+		sendError(w, "Invalid target URL", fmt.Errorf("cannot parse %q", targetURL))
+		return
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(parts[1])
-	if err != nil {
-		return false
+	if config.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxBody)
 	}
 
-	credentials := strings.SplitN(string(decoded), ":", 2)
-	if len(credentials) != 2 {
-		return false
+	if rewritten := applyRewriteRules(r, targetURL); rewritten != targetURL {
+		targetURL = rewritten
+		targetParsed, err = url.Parse(targetURL)
+		if err != nil || targetParsed.Host == "" {
+			sendError(w, "Invalid target URL after rewrite", fmt.Errorf("cannot parse %q", targetURL))
+			return
+		}
+	}
+
+	if config.Mock {
+		if entry, ok := mockLookup(r.Method, targetURL); ok {
+			serveMockEntry(w, entry)
+			return
+		}
+		sendError(w, "Mock miss", fmt.Errorf("no recorded response for %s %s", r.Method, targetURL))
+		return
+	}
+
+	if isWebSocketUpgrade(r) {
+		proxyWebSocket(w, r, targetParsed)
+		return
 	}
 
-	return credentials[0] == config.Username && credentials[1] == config.Password
+	newReverseProxy(targetParsed, targetURL).ServeHTTP(w, r)
 }
 
-func sendError(w http.ResponseWriter, message string, err error) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Error:   message,
-		Message: err.Error(),
+// skipProxyHeaders are headers that must never be forwarded verbatim to the
+// target: either they are specific to talking to this proxy (X-Target-URL,
+// Origin used only for CORS, Referer which would leak the proxy's own URL),
+// or httputil.ReverseProxy already strips them as hop-by-hop.
+var skipProxyHeaders = []string{"X-Target-URL", "Origin", "Referer"}
+
+// newReverseProxy builds a per-request httputil.ReverseProxy targeting
+// targetParsed. Director rewrites the request onto the target and applies
+// credential injection; ModifyResponse strips any CORS headers the upstream
+// sent so the policy computed by setCORSHeaders is what the client sees.
+func newReverseProxy(targetParsed *url.URL, targetURL string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = targetParsed
+			req.Host = targetParsed.Host
+			for _, h := range skipProxyHeaders {
+				req.Header.Del(h)
+			}
+			injectCredentials(req, targetURL)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			for key := range resp.Header {
+				if strings.HasPrefix(strings.ToLower(key), "access-control-") {
+					resp.Header.Del(key)
+				}
+			}
+			if config.RecordFile != "" && !isStreamingResponse(resp) {
+				if body, err := io.ReadAll(resp.Body); err == nil {
+					resp.Body.Close()
+					resp.Body = io.NopCloser(bytes.NewReader(body))
+					recordExchange(resp.Request, resp, body)
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			sendError(w, "Proxy error", err)
+			if correlationID, ok := r.Context().Value(correlationIDContextKey).(string); ok {
+				setProxyError(correlationID, err.Error())
+			}
+		},
+		Transport: withCache(proxyTransport()),
+		// -1 flushes every write to the client immediately instead of
+		// buffering, which is what SSE/chunked/long-poll responses need.
+		FlushInterval: -1,
+	}
+}
+
+var (
+	proxyTransportOnce sync.Once
+	sharedTransport    *http.Transport
+)
+
+// proxyTransport returns the shared http.Transport used for outbound
+// requests, honoring -timeout as a response-header timeout so a slow or
+// dead upstream can't hang a request forever while leaving long-lived
+// streaming responses (whose headers already arrived) alone.
+func proxyTransport() *http.Transport {
+	proxyTransportOnce.Do(func() {
+		sharedTransport = http.DefaultTransport.(*http.Transport).Clone()
+		if config.Timeout > 0 {
+			sharedTransport.ResponseHeaderTimeout = config.Timeout
+		}
 	})
-}
\ No newline at end of file
+	return sharedTransport
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// proxyWebSocket hijacks the client connection and opens a raw TCP (or TLS,
+// for wss/https targets) connection to the target, forwards the original
+// upgrade request, then bidirectionally copies frames until either side
+// closes. Reverse-proxying a WebSocket as an ordinary HTTP round trip
+// doesn't work because the connection is meant to stay open and carry
+// frames in both directions after the 101 response.
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, targetParsed *url.URL) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		sendError(w, "WebSocket proxying not supported", fmt.Errorf("ResponseWriter does not support hijacking"))
+		return
+	}
+
+	addr := targetParsed.Host
+	if !strings.Contains(addr, ":") {
+		if targetParsed.Scheme == "https" || targetParsed.Scheme == "wss" {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+
+	var targetConn net.Conn
+	var err error
+	if targetParsed.Scheme == "https" || targetParsed.Scheme == "wss" {
+		targetConn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: targetParsed.Hostname()})
+	} else {
+		targetConn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		sendError(w, "Proxy error", err)
+		return
+	}
+	defer targetConn.Close()
+
+	outReq := r.Clone(r.Context())
+	outReq.URL = targetParsed
+	outReq.Host = targetParsed.Host
+	for _, h := range skipProxyHeaders {
+		outReq.Header.Del(h)
+	}
+	injectCredentials(outReq, targetParsed.String())
+
+	if err := outReq.Write(targetConn); err != nil {
+		sendError(w, "Proxy error", err)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		sendError(w, "Proxy error", err)
+		return
+	}
+	defer clientConn.Close()
+
+	logStructured(logEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		RequestID: r.Header.Get("X-Request-Id"),
+		Target:    targetParsed.String(),
+		Method:    "WEBSOCKET",
+	})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(targetConn, clientBuf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, targetConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// --- Response cache -------------------------------------------------------
+//
+// The cache keys on method+target-URL+Authorization+Vary-listed request
+// headers, storing status, headers and body on disk under -cache-dir,
+// bounded to -cache-max-entries by an in-memory LRU. -cache=revalidate
+// follows normal HTTP freshness/conditional-request rules; -cache=replay
+// serves only from disk and never touches the network, which is useful for
+// offline development and deterministic test fixtures.
+
+// CacheEntry is both the in-memory and on-disk (as JSON + a sibling .body
+// file) representation of one cached response.
+type CacheEntry struct {
+	Key          string      `json:"key"`
+	BaseKey      string      `json:"baseKey"`
+	VaryHeaders  []string    `json:"varyHeaders,omitempty"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	StoredAt     time.Time   `json:"storedAt"`
+	MaxAgeSecs   int         `json:"maxAgeSecs"`
+	ETag         string      `json:"etag"`
+	LastModified string      `json:"lastModified"`
+	BodySize     int64       `json:"bodySize"`
+}
+
+var (
+	cacheMu    sync.Mutex
+	cacheIndex = map[string]*list.Element{} // key -> element in cacheOrder, value is *CacheEntry
+	cacheOrder = list.New()                 // front = most recently used
+)
+
+func cachePath(key string) (metaPath, bodyPath string) {
+	return filepath.Join(config.CacheDir, key+".json"), filepath.Join(config.CacheDir, key+".body")
+}
+
+// initCache creates -cache-dir if needed and loads any entries already on
+// disk from a previous run, so -cache=replay works without first having to
+// repopulate the cache in the same process.
+func initCache() error {
+	if err := os.MkdirAll(config.CacheDir, 0o755); err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(config.CacheDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for _, metaPath := range matches {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			continue
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		cacheIndex[entry.Key] = cacheOrder.PushFront(&entry)
+		if len(entry.VaryHeaders) > 0 {
+			setVaryHeaderNames(entry.BaseKey, entry.VaryHeaders)
+		}
+	}
+	return nil
+}
+
+// varyMu/varyByBaseKey remember, per cacheBaseKey, which request headers the
+// last cacheable response for that method+URL listed in Vary - so later
+// requests to the same URL can fold the same headers into cacheKey before
+// the (possibly not-yet-fetched) response is available to consult again.
+var (
+	varyMu        sync.Mutex
+	varyByBaseKey = map[string][]string{}
+)
+
+func varyHeaderNames(baseKey string) []string {
+	varyMu.Lock()
+	defer varyMu.Unlock()
+	return append([]string(nil), varyByBaseKey[baseKey]...)
+}
+
+func setVaryHeaderNames(baseKey string, names []string) {
+	varyMu.Lock()
+	defer varyMu.Unlock()
+	varyByBaseKey[baseKey] = names
+}
+
+func splitVaryNames(vary string) []string {
+	var names []string
+	for _, part := range strings.Split(vary, ",") {
+		if name := strings.TrimSpace(part); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// cacheBaseKey identifies a request by method+URL alone, before any
+// Vary-listed headers for it are known.
+func cacheBaseKey(method, targetURL string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(method) + " " + targetURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheKey folds in Authorization - so two callers with different
+// credentials for the same URL (the common case once -inject-config or
+// client-supplied bearer tokens are in play) never share a cached,
+// personalized response - plus whatever headers cacheBaseKey's last
+// cacheable response listed in Vary.
+func cacheKey(method, targetURL string, header http.Header) string {
+	base := cacheBaseKey(method, targetURL)
+	parts := []string{base, "authorization=" + header.Get("Authorization")}
+	for _, name := range varyHeaderNames(base) {
+		parts = append(parts, strings.ToLower(name)+"="+header.Get(name))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheGet(key string) (*CacheEntry, []byte, bool) {
+	cacheMu.Lock()
+	elem, ok := cacheIndex[key]
+	if ok {
+		cacheOrder.MoveToFront(elem)
+	}
+	cacheMu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+
+	entry := elem.Value.(*CacheEntry)
+	_, bodyPath := cachePath(key)
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	return entry, body, true
+}
+
+// cachePut stores entry+body on disk and in the LRU index, evicting the
+// least-recently-used entry (from both disk and index) if -cache-max-entries
+// is exceeded.
+func cachePut(entry *CacheEntry, body []byte) {
+	metaPath, bodyPath := cachePath(entry.Key)
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(bodyPath, body, 0o644); err != nil {
+		return
+	}
+	if err := os.WriteFile(metaPath, meta, 0o644); err != nil {
+		return
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if elem, ok := cacheIndex[entry.Key]; ok {
+		elem.Value = entry
+		cacheOrder.MoveToFront(elem)
+	} else {
+		cacheIndex[entry.Key] = cacheOrder.PushFront(entry)
+	}
+
+	for cacheOrder.Len() > config.CacheMaxEntries {
+		oldest := cacheOrder.Back()
+		if oldest == nil {
+			break
+		}
+		oldEntry := oldest.Value.(*CacheEntry)
+		cacheOrder.Remove(oldest)
+		delete(cacheIndex, oldEntry.Key)
+		oldMeta, oldBody := cachePath(oldEntry.Key)
+		os.Remove(oldMeta)
+		os.Remove(oldBody)
+	}
+}
+
+func cachePurgeAll() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	for key := range cacheIndex {
+		metaPath, bodyPath := cachePath(key)
+		os.Remove(metaPath)
+		os.Remove(bodyPath)
+	}
+	cacheIndex = map[string]*list.Element{}
+	cacheOrder = list.New()
+}
+
+func cacheSnapshot() []*CacheEntry {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	entries := make([]*CacheEntry, 0, len(cacheIndex))
+	for e := cacheOrder.Front(); e != nil; e = e.Next() {
+		entries = append(entries, e.Value.(*CacheEntry))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].StoredAt.After(entries[j].StoredAt) })
+	return entries
+}
+
+// isStreamingResponse reports whether resp looks like an SSE/long-poll
+// stream rather than a complete, bounded document: either it declares
+// text/event-stream, or its length is unknown up front (chunked with no
+// Content-Length), which in practice means "arrives over time". Buffering
+// either kind with io.ReadAll before caching or recording would block the
+// client on the whole stream instead of flushing it as chunk0-3 intends.
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
+		return true
+	}
+	return resp.ContentLength < 0
+}
+
+// cacheable reports whether resp is safe to cache under normal HTTP
+// semantics: a successful, non-streaming GET/HEAD response that upstream
+// hasn't marked no-store or Vary: * (which means "not cacheable at all"
+// under RFC 9111).
+func cacheable(method string, resp *http.Response) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if isStreamingResponse(resp) {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-store")
+}
+
+func parseMaxAge(cacheControl string) int {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, directive[:8])); err == nil {
+				return secs
+			}
+		}
+	}
+	return -1
+}
+
+func entryToResponse(req *http.Request, entry *CacheEntry, body []byte) *http.Response {
+	header := entry.Header.Clone()
+	header.Set("X-Cache", "HIT")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode:    entry.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// cachingTransport wraps another http.RoundTripper and implements -cache's
+// off/revalidate/replay modes around it.
+type cachingTransport struct {
+	next http.RoundTripper
+}
+
+func withCache(next http.RoundTripper) http.RoundTripper {
+	if config.CacheMode == "off" {
+		return next
+	}
+	return &cachingTransport{next: next}
+}
+
+func (c *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// cacheable only ever stores GET/HEAD 200s, so a non-GET/HEAD
+		// request can never have a cache entry to replay - pass it straight
+		// through instead of -cache=replay permanently failing every
+		// mutating request with "no cached entry", which would otherwise
+		// make replay mode unusable for the offline-fixture workflows it's
+		// meant to support whenever they include a POST/PUT/DELETE.
+		return c.next.RoundTrip(req)
+	}
+
+	baseKey := cacheBaseKey(req.Method, req.URL.String())
+	key := cacheKey(req.Method, req.URL.String(), req.Header)
+	entry, body, hit := cacheGet(key)
+
+	if config.CacheMode == "replay" {
+		if !hit {
+			return nil, fmt.Errorf("cache replay: no cached entry for %s %s", req.Method, req.URL)
+		}
+		return entryToResponse(req, entry, body), nil
+	}
+
+	// revalidate mode
+	if hit {
+		age := time.Since(entry.StoredAt)
+		if entry.MaxAgeSecs > 0 && age < time.Duration(entry.MaxAgeSecs)*time.Second {
+			return entryToResponse(req, entry, body), nil
+		}
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if hit && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry.StoredAt = time.Now()
+		cachePut(entry, body)
+		return entryToResponse(req, entry, body), nil
+	}
+
+	if !cacheable(req.Method, resp) {
+		return resp, nil
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	varyNames := splitVaryNames(resp.Header.Get("Vary"))
+	if len(varyNames) > 0 {
+		setVaryHeaderNames(baseKey, varyNames)
+		key = cacheKey(req.Method, req.URL.String(), req.Header)
+	}
+
+	cachePut(&CacheEntry{
+		Key:          key,
+		BaseKey:      baseKey,
+		VaryHeaders:  varyNames,
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		StoredAt:     time.Now(),
+		MaxAgeSecs:   parseMaxAge(resp.Header.Get("Cache-Control")),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		BodySize:     int64(len(responseBody)),
+	}, responseBody)
+
+	return resp, nil
+}
+
+func handleCacheList(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r, "")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !checkAuth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cacheSnapshot())
+}
+
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r, "")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !checkAuth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cachePurgeAll()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HAR is a minimal HTTP Archive (http://www.softwareishard.com/blog/har-12-spec/)
+// document, just enough to round-trip what the cache stores so entries can
+// be shared with teammates or replayed elsewhere.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+}
+
+type HARRequest struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers []HARHeader `json:"headers"`
+}
+
+type HARResponse struct {
+	Status  int         `json:"status"`
+	Headers []HARHeader `json:"headers"`
+	Content HARContent  `json:"content"`
+}
+
+type HARHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+func handleCacheExport(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r, "")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !checkAuth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	entries := cacheSnapshot()
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "api-client2 proxy cache", Version: "1.0.0"},
+		Entries: make([]HAREntry, 0, len(entries)),
+	}}
+
+	for _, entry := range entries {
+		_, body, ok := cacheGet(entry.Key)
+		if !ok {
+			continue
+		}
+		har.Log.Entries = append(har.Log.Entries, HAREntry{
+			StartedDateTime: entry.StoredAt.UTC().Format(time.RFC3339),
+			Request: HARRequest{
+				Method:  entry.Method,
+				URL:     entry.URL,
+				Headers: toHARHeaders(nil),
+			},
+			Response: HARResponse{
+				Status:  entry.Status,
+				Headers: toHARHeaders(entry.Header),
+				Content: HARContent{
+					Size:     int64(len(body)),
+					MimeType: entry.Header.Get("Content-Type"),
+					Text:     string(body),
+				},
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="proxy-cache.har"`)
+	json.NewEncoder(w).Encode(har)
+}
+
+func toHARHeaders(header http.Header) []HARHeader {
+	out := make([]HARHeader, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			out = append(out, HARHeader{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+// --- Request rewriting ----------------------------------------------------
+//
+// -rewrite-config lets an operator patch requests before they're forwarded:
+// redirect them to a different URL, add/remove headers, or patch fields of
+// a JSON body. It's the same shape of problem as credential injection above,
+// generalized to arbitrary mutations instead of just Authorization.
+
+// applyRewriteRules finds the first configured rule whose Method/URLGlob/
+// HeaderMatch all match the request and applies its header and body
+// mutations in place, returning the (possibly rewritten) target URL.
+func applyRewriteRules(r *http.Request, targetURL string) string {
+	rewriteMu.RLock()
+	rules := rewriteConfig.Rules
+	rewriteMu.RUnlock()
+
+	for _, rule := range rules {
+		if !rewriteRuleMatches(rule, r, targetURL) {
+			continue
+		}
+
+		for _, name := range rule.RemoveHeaders {
+			r.Header.Del(name)
+		}
+		for name, value := range rule.SetHeaders {
+			r.Header.Set(name, value)
+		}
+		if len(rule.BodyPatches) > 0 {
+			applyBodyPatches(r, rule.BodyPatches)
+		}
+		if rule.SetURL != "" {
+			return rule.SetURL
+		}
+		return targetURL
+	}
+	return targetURL
+}
+
+func rewriteRuleMatches(rule RewriteRule, r *http.Request, targetURL string) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if rule.URLGlob != "" && !globMatch(rule.URLGlob, targetURL) {
+		return false
+	}
+	for name, want := range rule.HeaderMatch {
+		if r.Header.Get(name) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// applyBodyPatches re-encodes r.Body as JSON with each patch's dotted path
+// set to its configured value. A non-JSON-object body is restored untouched
+// rather than rejected, since a rewrite rule may match requests the caller
+// didn't expect to carry a body.
+func applyBodyPatches(r *http.Request, patches []BodyPatch) {
+	if r.Body == nil {
+		return
+	}
+	raw, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return
+	}
+
+	doc := map[string]interface{}{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			r.Body = io.NopCloser(bytes.NewReader(raw))
+			r.ContentLength = int64(len(raw))
+			return
+		}
+	}
+
+	for _, patch := range patches {
+		setJSONPath(doc, strings.Split(patch.Path, "."), patch.Value)
+	}
+
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		r.ContentLength = int64(len(raw))
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(patched))
+	r.ContentLength = int64(len(patched))
+	r.Header.Set("Content-Length", strconv.Itoa(len(patched)))
+}
+
+// setJSONPath sets value at the dotted path inside doc, creating
+// intermediate objects as needed. Array indices aren't supported, matching
+// the simple field-patch use case -rewrite-config targets.
+func setJSONPath(doc map[string]interface{}, segments []string, value interface{}) {
+	if len(segments) == 1 {
+		doc[segments[0]] = value
+		return
+	}
+	next, ok := doc[segments[0]].(map[string]interface{})
+	if !ok {
+		next = map[string]interface{}{}
+		doc[segments[0]] = next
+	}
+	setJSONPath(next, segments[1:], value)
+}
+
+// --- Recording and mock mode -----------------------------------------------
+//
+// -record-file appends every forwarded (post-rewrite) request/response pair
+// to a HAR file, reusing the same HAR types the cache exports to. -mock then
+// serves responses straight out of that file instead of reaching upstream,
+// turning a captured session into a replayable fixture.
+
+// loadRecording reads -record-file's existing entries (if the file exists
+// yet) into memory, so recording appends to history across restarts and
+// -mock has something to serve without first needing a live capture.
+func loadRecording() error {
+	if config.RecordFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(config.RecordFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		return fmt.Errorf("parsing %s: %w", config.RecordFile, err)
+	}
+
+	recordMu.Lock()
+	recordEntries = har.Log.Entries
+	recordMu.Unlock()
+	return nil
+}
+
+func redactedHeaderNames() map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(config.RecordRedact, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	return names
+}
+
+func toRedactedHARHeaders(header http.Header, redact map[string]bool) []HARHeader {
+	out := make([]HARHeader, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			if redact[strings.ToLower(name)] {
+				value = "[redacted]"
+			}
+			out = append(out, HARHeader{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+// setHARHeader replaces every occurrence of name in headers with a single
+// entry carrying value, appending one if name wasn't present.
+func setHARHeader(headers []HARHeader, name, value string) []HARHeader {
+	out := make([]HARHeader, 0, len(headers)+1)
+	replaced := false
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			if replaced {
+				continue
+			}
+			h.Value = value
+			replaced = true
+		}
+		out = append(out, h)
+	}
+	if !replaced {
+		out = append(out, HARHeader{Name: name, Value: value})
+	}
+	return out
+}
+
+// recordExchange appends one HAR entry for a forwarded request/response pair
+// to -record-file, redacting configured headers and capping the captured
+// body at -record-max-body. It re-marshals the whole entry list on every
+// call rather than holding an open append handle, trading some overhead for
+// always leaving a complete, valid HAR document on disk.
+func recordExchange(req *http.Request, resp *http.Response, body []byte) {
+	if config.RecordFile == "" {
+		return
+	}
+
+	redact := redactedHeaderNames()
+	text := body
+	truncated := false
+	if config.RecordMaxBody > 0 && int64(len(text)) > config.RecordMaxBody {
+		text = text[:config.RecordMaxBody]
+		truncated = true
+	}
+	content := string(text)
+	if truncated {
+		content += "...[truncated]"
+	}
+
+	responseHeaders := toRedactedHARHeaders(resp.Header, redact)
+	if truncated {
+		// The recorded Content-Length must match the (now-truncated)
+		// Content.Text or serveMockEntry would later send a body whose
+		// length disagrees with its own Content-Length header.
+		responseHeaders = setHARHeader(responseHeaders, "Content-Length", strconv.Itoa(len(content)))
+	}
+
+	entry := HAREntry{
+		StartedDateTime: time.Now().UTC().Format(time.RFC3339),
+		Request: HARRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Headers: toRedactedHARHeaders(req.Header, redact),
+		},
+		Response: HARResponse{
+			Status:  resp.StatusCode,
+			Headers: responseHeaders,
+			Content: HARContent{
+				Size:     int64(len(body)),
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     content,
+			},
+		},
+	}
+
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	recordEntries = append(recordEntries, entry)
+
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "api-client2 proxy recorder", Version: "1.0.0"},
+		Entries: recordEntries,
+	}}
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		log.Printf("record: failed to marshal %s: %v", config.RecordFile, err)
+		return
+	}
+	if err := os.WriteFile(config.RecordFile, data, 0o644); err != nil {
+		log.Printf("record: failed to write %s: %v", config.RecordFile, err)
+	}
+}
+
+// mockLookup returns the most recently recorded response for method+url,
+// for -mock mode to serve instead of forwarding upstream.
+func mockLookup(method, targetURL string) (*HAREntry, bool) {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	for i := len(recordEntries) - 1; i >= 0; i-- {
+		if strings.EqualFold(recordEntries[i].Request.Method, method) && recordEntries[i].Request.URL == targetURL {
+			return &recordEntries[i], true
+		}
+	}
+	return nil, false
+}
+
+func serveMockEntry(w http.ResponseWriter, entry *HAREntry) {
+	for _, h := range entry.Response.Headers {
+		w.Header().Add(h.Name, h.Value)
+	}
+	w.Header().Set("X-Mock", "HIT")
+	w.WriteHeader(entry.Response.Status)
+	w.Write([]byte(entry.Response.Content.Text))
+}
+
+// injectCredentials strips whatever Authorization the client sent and, if a
+// configured rule matches targetURL, injects the operator's own credential
+// header instead. This keeps upstream secrets out of the browser/dev tools
+// entirely: the client only ever needs a proxy token, never the real one.
+// This is separate from (and runs after) the stripping checkAuth/
+// checkTokenAuth already did for whichever header authenticated the caller
+// to the proxy itself - this one handles the "no proxy auth configured, but
+// operator still wants per-target credentials swapped in" case.
+func injectCredentials(proxyReq *http.Request, targetURL string) {
+	injectMu.RLock()
+	rules := injectConfig.Rules
+	injectMu.RUnlock()
+
+	if len(rules) == 0 {
+		return
+	}
+
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return
+	}
+
+	for _, rule := range rules {
+		if !ruleMatchesTarget(rule, targetURL, parsed) {
+			continue
+		}
+
+		proxyReq.Header.Del("Authorization")
+		if rule.Header != "" && rule.Value != "" {
+			proxyReq.Header.Set(rule.Header, rule.Value)
+		}
+		return
+	}
+}
+
+func ruleMatchesTarget(rule InjectRule, targetURL string, parsed *url.URL) bool {
+	if rule.TargetPrefix == "" && rule.TargetHost == "" {
+		return false
+	}
+	if rule.TargetPrefix != "" && !strings.HasPrefix(targetURL, rule.TargetPrefix) {
+		return false
+	}
+	if rule.TargetHost != "" && parsed.Host != rule.TargetHost {
+		return false
+	}
+	return true
+}
+
+// setCORSHeaders writes response headers for the CORS policy selected for
+// targetURL. It only ever echoes the Origin request header
+// back when it actually matches an allowed pattern - it never blindly
+// reflects "*" together with Access-Control-Allow-Credentials: true, which
+// every major browser rejects.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, targetURL string) {
+	policy, ok := selectCORSPolicy(targetURL)
+	if !ok {
+		// Per-target policies are configured but this request didn't carry
+		// enough to know which one applies - typically a preflight OPTIONS
+		// sent via the X-Target-URL header convention, which browsers never
+		// include on the preflight itself. Granting no CORS headers at all
+		// denies the preflight rather than silently approving it under the
+		// permissive default, which would let every origin through for the
+		// one request per-target policies exist to restrict.
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin != "" && originAllowed(origin, policy.AllowedOrigins) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	} else if containsPattern(policy.AllowedOrigins, "*") && !policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+
+	if len(policy.AllowedMethods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+	}
+
+	// Preflight should echo back only the headers the browser actually
+	// asked for, computed from Access-Control-Request-Headers, rather than
+	// a blanket "*" (which is invalid alongside credentialed requests).
+	if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requested)
+	} else if len(policy.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+	}
+
+	if len(policy.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+	}
+
+	if policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", policy.MaxAge))
+	}
+}
+
+// selectCORSPolicy returns the first configured policy whose TargetGlob
+// matches targetURL, falling back to a policy built from the legacy
+// -origin flag (or the hard-coded default) when -cors-config is unset.
+// ok is false only when -cors-config has per-target policies configured but
+// targetURL is empty: that means none of them could be matched against
+// (the common case is a preflight OPTIONS using the X-Target-URL header
+// convention, since browsers never send custom headers on the preflight
+// itself), and falling back to the permissive default in that case would
+// defeat every per-target restriction for exactly the request they exist
+// to gate.
+func selectCORSPolicy(targetURL string) (policy CORSPolicy, ok bool) {
+	corsMu.RLock()
+	policies := corsConfig.Policies
+	corsMu.RUnlock()
+
+	for _, p := range policies {
+		if p.TargetGlob == "" || globMatch(p.TargetGlob, targetURL) {
+			return p, true
+		}
+	}
+
+	if len(policies) > 0 && targetURL == "" {
+		return CORSPolicy{}, false
+	}
+
+	fallback := defaultCORSPolicy
+	if config.Origin != "" {
+		fallback.AllowedOrigins = []string{config.Origin}
+	}
+	return fallback, true
+}
+
+func originAllowed(origin string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesOriginPattern(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPattern(patterns []string, want string) bool {
+	for _, pattern := range patterns {
+		if pattern == want {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesOriginPattern(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "regex:") {
+		re, err := regexp.Compile(pattern[len("regex:"):])
+		if err != nil {
+			return false
+		}
+		return re.MatchString(origin)
+	}
+	if strings.Contains(pattern, "*") {
+		return globMatch(pattern, origin)
+	}
+	return pattern == origin
+}
+
+// globMatch reports whether s matches pattern, where "*" in pattern matches
+// any run of characters (including none, and including "/"). It's used both
+// for CORS origin wildcards (e.g. "https://*.example.com") and for
+// -cors-config target globs (e.g. "https://api.example.com/*").
+func globMatch(pattern, s string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == s
+	}
+	re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+func checkAuth(r *http.Request) bool {
+	if checkTokenAuth(r) {
+		return true
+	}
+
+	if config.Username == "" || config.Password == "" {
+		return authConfigEmpty()
+	}
+
+	// Proxy-Authorization is the header clients are expected to use, so
+	// Authorization is left untouched for the upstream in that case. When a
+	// client falls back to sending the proxy's own Basic credential via
+	// Authorization instead, that value must not reach upstream - see the
+	// matching strip below.
+	usedAuthorizationFallback := false
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		auth = r.Header.Get("Authorization")
+		usedAuthorizationFallback = true
+	}
+
+	if auth == "" {
+		return false
+	}
+
+	parts := strings.SplitN(auth, " ", 2)
+	if len(parts) != 2 || parts[0] != "Basic" {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return false
+	}
+
+	if credentials[0] != config.Username || credentials[1] != config.Password {
+		return false
+	}
+
+	// The proxy's own Basic credential must never be forwarded to whatever
+	// arbitrary host X-Target-URL/?url= names.
+	if usedAuthorizationFallback {
+		r.Header.Del("Authorization")
+	}
+	return true
+}
+
+// authConfigEmpty reports whether no auth mode is configured at all, in
+// which case requests are allowed through unauthenticated as before.
+func authConfigEmpty() bool {
+	authMu.RLock()
+	defer authMu.RUnlock()
+	return len(authConfig.Tokens) == 0
+}
+
+// checkTokenAuth validates a bearer token carried either as a standard
+// `Authorization: Bearer <token>` header or as `X-Proxy-Access-Token`,
+// against the token list loaded from -auth-config. On success it strips
+// whichever header carried the token: it's the proxy's own credential, not
+// an upstream one, and must not be forwarded just because no -inject-config
+// rule happens to match this target.
+func checkTokenAuth(r *http.Request) bool {
+	authMu.RLock()
+	tokens := authConfig.Tokens
+	authMu.RUnlock()
+
+	if len(tokens) == 0 {
+		return false
+	}
+
+	usedAuthorizationHeader := false
+	token := r.Header.Get("X-Proxy-Access-Token")
+	if token == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+			usedAuthorizationHeader = true
+		}
+	}
+
+	if token == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	tokenHash := hex.EncodeToString(sum[:])
+
+	for _, entry := range tokens {
+		matched := entry.Token != "" && subtle.ConstantTimeCompare([]byte(entry.Token), []byte(token)) == 1
+		matched = matched || (entry.Sha256 != "" && subtle.ConstantTimeCompare([]byte(entry.Sha256), []byte(tokenHash)) == 1)
+		if !matched {
+			continue
+		}
+
+		r.Header.Del("X-Proxy-Access-Token")
+		if usedAuthorizationHeader {
+			r.Header.Del("Authorization")
+		}
+		return true
+	}
+	return false
+}
+
+func sendError(w http.ResponseWriter, message string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   message,
+		Message: err.Error(),
+	})
+}